@@ -0,0 +1,71 @@
+package queryrange
+
+import (
+	"context"
+	"time"
+
+	"github.com/weaveworks/common/user"
+)
+
+// Limits allows us to specify per-tenant runtime limits on the behavior of
+// the query handling code.
+type Limits interface {
+	// MaxQueryParallelism returns the limit to the number of split queries the
+	// frontend will process in parallel.
+	MaxQueryParallelism(userID string) int
+
+	// QuerySplitDuration returns the tenant specific value for split_queries_by_interval,
+	// or zero if the tenant has no override.
+	QuerySplitDuration(userID string) time.Duration
+
+	// QuerySplitDurationRecent returns the tenant specific value for
+	// split_queries_by_interval_recent, or zero if the tenant has no override.
+	QuerySplitDurationRecent(userID string) time.Duration
+
+	// MaxQueryLookback returns the max lookback period beyond which queries
+	// are not processed, or zero for no limit.
+	MaxQueryLookback(userID string) time.Duration
+}
+
+// LimitsMiddleware creates a new Middleware that enforces tenant query limits.
+func LimitsMiddleware(l Limits, codec Codec) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return limitsMiddleware{
+			next:   next,
+			limits: l,
+			codec:  codec,
+			now:    time.Now,
+		}
+	})
+}
+
+type limitsMiddleware struct {
+	next   Handler
+	limits Limits
+	codec  Codec
+	now    func() time.Time
+}
+
+func (l limitsMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	userID, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return l.next.Do(ctx, r)
+	}
+
+	lookback := l.limits.MaxQueryLookback(userID)
+	if lookback == 0 {
+		return l.next.Do(ctx, r)
+	}
+
+	minStart := l.now().Add(-lookback).UnixNano() / int64(time.Millisecond)
+	if r.GetEnd() < minStart {
+		// The entire query range is older than the tenant's lookback limit:
+		// avoid hitting the downstream handler altogether.
+		return l.codec.NewEmptyResponse(r)
+	}
+	if r.GetStart() < minStart {
+		r = r.WithStartEnd(minStart, r.GetEnd())
+	}
+
+	return l.next.Do(ctx, r)
+}
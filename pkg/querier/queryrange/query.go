@@ -0,0 +1,68 @@
+package queryrange
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gogo/protobuf/proto"
+	opentracing "github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// Request represents a query range request that can be process by middlewares.
+type Request interface {
+	// GetStart returns the start timestamp of the request in milliseconds.
+	GetStart() int64
+	// GetEnd returns the end timestamp of the request in milliseconds.
+	GetEnd() int64
+	// GetStep returns the step of the request in milliseconds.
+	GetStep() int64
+	// GetQuery returns the query of the request.
+	GetQuery() string
+	// WithStartEnd clones the current request with a different start and end timestamp.
+	WithStartEnd(start, end int64) Request
+	// WithQuery clones the current request with a different query.
+	WithQuery(string) Request
+	proto.Message
+}
+
+// Response represents a query range response.
+type Response interface {
+	proto.Message
+}
+
+// Merger is used by middlewares making multiple requests to merge back all responses into a single one.
+type Merger interface {
+	// MergeResponse merges responses from multiple requests into a single Response.
+	MergeResponse(...Response) (Response, error)
+}
+
+// Codec is used to encode/decode query range requests and responses so they can be passed down to middlewares.
+type Codec interface {
+	Merger
+	// DecodeRequest decodes a Request from an http request.
+	DecodeRequest(_ context.Context, request *http.Request) (Request, error)
+	// DecodeResponse decodes a Response from an http response.
+	DecodeResponse(_ context.Context, response *http.Response, forRequest Request) (Response, error)
+	// EncodeRequest encodes a Request into an http request.
+	EncodeRequest(_ context.Context, request Request) (*http.Request, error)
+	// EncodeResponse encodes a Response into an http response.
+	EncodeResponse(_ context.Context, response Response) (*http.Response, error)
+	// NewEmptyResponse builds an empty, valid Response for the given Request,
+	// so that requests that can be short-circuited still produce a response
+	// of the correct shape (e.g. matrix vs vector) for downstream middlewares.
+	NewEmptyResponse(Request) (Response, error)
+}
+
+// LogToSpan writes information about the request to the active span, if any.
+func LogToSpan(ctx context.Context, r Request) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.LogFields(
+			otlog.String("query", r.GetQuery()),
+			otlog.String("start", timestamp.Time(r.GetStart()).String()),
+			otlog.String("end", timestamp.Time(r.GetEnd()).String()),
+			otlog.Int64("step (ms)", r.GetStep()),
+		)
+	}
+}
@@ -0,0 +1,122 @@
+package queryrange
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/weaveworks/common/user"
+
+	"github.com/cortexproject/cortex/pkg/chunk/cache"
+)
+
+// ResultsCacheConfig configures the results cache middleware.
+type ResultsCacheConfig struct {
+	CacheConfig cache.Config `yaml:"cache"`
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet.
+func (cfg *ResultsCacheConfig) RegisterFlags(f *flag.FlagSet) {
+	cfg.CacheConfig.RegisterFlagsWithPrefix("frontend.", "", f)
+}
+
+// Extractor extracts the sub-range [start,end] of samples from a Response
+// cached for a wider range. resultsCache accepts one for interface parity
+// with its caller, but its current exact-match cache keys (see cacheKey)
+// never produce a partial overlap for it to resolve; it's unused until this
+// middleware grows range-overlapping cache entries.
+type Extractor interface {
+	Extract(start, end int64, resp Response) Response
+}
+
+// NewResultsCacheMiddleware creates a new Middleware that caches whole
+// Responses keyed by the Request that produced them.
+func NewResultsCacheMiddleware(logger log.Logger, cfg ResultsCacheConfig, limits Limits, codec Codec, extractor Extractor, alignment SplitQueriesAlignment) (Middleware, cache.Cache, error) {
+	c, err := cache.New(cfg.CacheConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return MiddlewareFunc(func(next Handler) Handler {
+		return &resultsCache{
+			logger:    logger,
+			cache:     c,
+			limits:    limits,
+			codec:     codec,
+			extractor: extractor,
+			alignment: alignment,
+			next:      next,
+		}
+	}), c, nil
+}
+
+type resultsCache struct {
+	logger    log.Logger
+	cache     cache.Cache
+	limits    Limits
+	codec     Codec
+	extractor Extractor
+	alignment SplitQueriesAlignment
+	next      Handler
+}
+
+func (r *resultsCache) Do(ctx context.Context, req Request) (Response, error) {
+	key := r.cacheKey(ctx, req)
+
+	if found, bufs, _ := r.cache.Fetch(ctx, []string{key}); len(found) == 1 {
+		resp, err := r.decode(ctx, bufs[0], req)
+		if err == nil {
+			return resp, nil
+		}
+		level.Warn(r.logger).Log("msg", "failed to decode cached results, re-fetching", "key", key, "err", err)
+	}
+
+	resp, err := r.next.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := r.encode(ctx, resp)
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed to encode results for caching", "key", key, "err", err)
+		return resp, nil
+	}
+	r.cache.Store(ctx, []string{key}, [][]byte{buf})
+
+	return resp, nil
+}
+
+// cacheKey returns the cache key for req. It incorporates r.alignment via
+// SplitQueriesAlignment.CacheKeySuffix(), so that a deployment switching
+// between alignment modes (or running mixed-mode during a rollout) is never
+// served a cached sub-query result computed under a different alignment than
+// the one in force for req.
+func (r *resultsCache) cacheKey(ctx context.Context, req Request) string {
+	userID, _ := user.ExtractOrgID(ctx)
+	return fmt.Sprintf("%s:%s:%d:%d:%d%s", userID, req.GetQuery(), req.GetStart(), req.GetEnd(), req.GetStep(), r.alignment.CacheKeySuffix())
+}
+
+// encode renders resp through the codec, the same bytes it would produce on
+// the wire, so a cache entry is just those bytes.
+func (r *resultsCache) encode(ctx context.Context, resp Response) ([]byte, error) {
+	httpResp, err := r.codec.EncodeResponse(ctx, resp)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = httpResp.Body.Close() }()
+	return ioutil.ReadAll(httpResp.Body)
+}
+
+// decode is the inverse of encode: it wraps buf as the body of a synthetic
+// http.Response so it can be run back through the codec's DecodeResponse.
+func (r *resultsCache) decode(ctx context.Context, buf []byte, req Request) (Response, error) {
+	httpResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(buf)),
+	}
+	return r.codec.DecodeResponse(ctx, httpResp, req)
+}
@@ -18,6 +18,7 @@ package queryrange
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -32,14 +33,89 @@ import (
 
 const day = 24 * time.Hour
 
+// Names of the middlewares composed by NewTripperware, exported so tests and
+// metrics can reference them without relying on string literals.
+const (
+	StepAlignMiddlewareName       = "step_align"
+	SplitByIntervalMiddlewareName = "split_by_interval"
+	ResultsCacheMiddlewareName    = "results_cache"
+	RetryMiddlewareName           = "retry"
+)
+
+// SplitQueriesAlignment controls where SplitByIntervalMiddleware places split
+// boundaries within a query range.
+type SplitQueriesAlignment int
+
+const (
+	// Duration splits the range into fixed-size windows whose boundaries fall
+	// on multiples of the interval since the Unix epoch (the historical
+	// behavior).
+	Duration SplitQueriesAlignment = iota
+	// CalendarDay splits the range at 00:00 UTC day boundaries.
+	CalendarDay
+	// CalendarWeek splits the range at 00:00 UTC Monday boundaries.
+	CalendarWeek
+)
+
+// String implements flag.Value.
+func (a SplitQueriesAlignment) String() string {
+	switch a {
+	case CalendarDay:
+		return "calendar_day"
+	case CalendarWeek:
+		return "calendar_week"
+	default:
+		return "duration"
+	}
+}
+
+// Set implements flag.Value.
+func (a *SplitQueriesAlignment) Set(s string) error {
+	switch s {
+	case "", "duration":
+		*a = Duration
+	case "calendar_day":
+		*a = CalendarDay
+	case "calendar_week":
+		*a = CalendarWeek
+	default:
+		return fmt.Errorf("unrecognized split_queries_alignment %q, must be one of: duration, calendar_day, calendar_week", s)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (a *SplitQueriesAlignment) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return a.Set(s)
+}
+
+// CacheKeySuffix returns a short, stable token identifying the alignment
+// mode. resultsCache appends it to every cache key it generates; see the doc
+// comment on Config.SplitQueriesAlignment for why.
+func (a SplitQueriesAlignment) CacheKeySuffix() string {
+	return ":" + a.String()
+}
+
 // Config for query_range middleware chain.
 type Config struct {
-	SplitQueriesByInterval time.Duration `yaml:"split_queries_by_interval"`
-	SplitQueriesByDay      bool          `yaml:"split_queries_by_day"`
-	AlignQueriesWithStep   bool          `yaml:"align_queries_with_step"`
-	ResultsCacheConfig     `yaml:"results_cache"`
-	CacheResults           bool `yaml:"cache_results"`
-	MaxRetries             int  `yaml:"max_retries"`
+	SplitQueriesByInterval       time.Duration `yaml:"split_queries_by_interval"`
+	SplitQueriesByIntervalRecent time.Duration `yaml:"split_queries_by_interval_recent"`
+	QueryIngestersWithin         time.Duration `yaml:"query_ingesters_within"`
+	SplitQueriesByDay            bool          `yaml:"split_queries_by_day"`
+	// SplitQueriesAlignment changes where split boundaries within the
+	// historical (non-recent) portion of the range fall. resultsCache's cache
+	// keys incorporate it (via CacheKeySuffix()), so a deployment switching
+	// between modes (or running mixed-mode during a rollout) doesn't serve
+	// cached sub-query results computed under a different alignment.
+	SplitQueriesAlignment SplitQueriesAlignment `yaml:"split_queries_alignment"`
+	AlignQueriesWithStep  bool                  `yaml:"align_queries_with_step"`
+	ResultsCacheConfig    `yaml:"results_cache"`
+	CacheResults          bool `yaml:"cache_results"`
+	MaxRetries            int  `yaml:"max_retries"`
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet.
@@ -47,6 +123,9 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.IntVar(&cfg.MaxRetries, "querier.max-retries-per-request", 5, "Maximum number of retries for a single request; beyond this, the downstream error is returned.")
 	f.BoolVar(&cfg.SplitQueriesByDay, "querier.split-queries-by-day", false, "Deprecated: Split queries by day and execute in parallel.")
 	f.DurationVar(&cfg.SplitQueriesByInterval, "querier.split-queries-by-interval", 0, "Split queries by an interval and execute in parallel, 0 disables it. You should use an a multiple of 24 hours (same as the storage bucketing scheme), to avoid queriers downloading and processing the same chunks.")
+	f.DurationVar(&cfg.SplitQueriesByIntervalRecent, "querier.split-queries-by-interval-recent", 0, "Split the portion of a query range that falls within query-ingesters-within by this interval instead of split-queries-by-interval, 0 falls back to split-queries-by-interval. Smaller values parallelise ingester-bound queries more finely.")
+	f.DurationVar(&cfg.QueryIngestersWithin, "querier.query-ingesters-within", 0, "Length of the window before a query's end that is split by split-queries-by-interval-recent instead of split-queries-by-interval. 0 splits the whole range by split-queries-by-interval.")
+	f.Var(&cfg.SplitQueriesAlignment, "querier.split-queries-alignment", "How to align split-by-interval boundaries within the historical portion of a query: duration (default, fixed-size windows aligned to multiples of the interval since the Unix epoch), calendar_day or calendar_week (snap to 00:00 UTC day/week boundaries, matching calendar-bucketed storage layouts).")
 	f.BoolVar(&cfg.AlignQueriesWithStep, "querier.align-querier-with-step", false, "Mutate incoming queries to align their start and end with their step.")
 	f.BoolVar(&cfg.CacheResults, "querier.cache-results", false, "Cache query results.")
 	cfg.ResultsCacheConfig.RegisterFlags(f)
@@ -91,29 +170,42 @@ func MergeMiddlewares(middleware ...Middleware) Middleware {
 
 // NewTripperware returns a Tripperware configured with middlewares to limit, align, split, retry and cache requests.
 func NewTripperware(cfg Config, log log.Logger, limits Limits, codec Codec, cacheExtractor Extractor) (frontend.Tripperware, cache.Cache, error) {
-	queryRangeMiddleware := []Middleware{LimitsMiddleware(limits)}
+	// LimitsMiddleware is wired in as the outermost middleware too, ahead of
+	// split-by-interval: without this, a query entirely outside
+	// max_query_lookback would still be fanned out into every split
+	// sub-query before each one individually short-circuited, wasting the
+	// split and every downstream call it produces.
+	queryRangeMiddleware := []Middleware{LimitsMiddleware(limits, codec)}
 	if cfg.AlignQueriesWithStep {
-		queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware("step_align"), StepAlignMiddleware)
+		queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware(StepAlignMiddlewareName), StepAlignMiddleware)
 	}
 	// SplitQueriesByDay is deprecated use SplitQueriesByInterval.
 	if cfg.SplitQueriesByDay {
 		level.Warn(log).Log("msg", "flag querier.split-queries-by-day (or config split_queries_by_day) is deprecated, use querier.split-queries-by-interval instead.")
 		cfg.SplitQueriesByInterval = day
 	}
-	if cfg.SplitQueriesByInterval != 0 {
-		queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware("split_by_interval"), SplitByIntervalMiddleware(cfg.SplitQueriesByInterval, limits, codec))
-	}
+	// Always wire in the split-by-interval middleware: even when the global
+	// SplitQueriesByInterval is unset, a tenant may have a non-zero override
+	// via the Limits interface, and splitByIntervalMiddleware resolves that
+	// per-request rather than at wiring time.
+	queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware(SplitByIntervalMiddlewareName), SplitByIntervalMiddleware(cfg.SplitQueriesByInterval, cfg.SplitQueriesByIntervalRecent, cfg.QueryIngestersWithin, cfg.SplitQueriesAlignment, limits, codec))
 	var c cache.Cache
 	if cfg.CacheResults {
-		queryCacheMiddleware, cache, err := NewResultsCacheMiddleware(log, cfg.ResultsCacheConfig, limits, codec, cacheExtractor)
+		queryCacheMiddleware, cache, err := NewResultsCacheMiddleware(log, cfg.ResultsCacheConfig, limits, codec, cacheExtractor, cfg.SplitQueriesAlignment)
 		if err != nil {
 			return nil, nil, err
 		}
 		c = cache
-		queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware("results_cache"), queryCacheMiddleware)
+		queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware(ResultsCacheMiddlewareName), queryCacheMiddleware)
 	}
+	// LimitsMiddleware also runs here, inner to split and the results cache:
+	// it clips or short-circuits each split sub-query individually, and
+	// unlike the outer instance above, its short-circuit response is a value
+	// the cache middleware's Do observes (via its next.Do call) and stores,
+	// rather than a short-circuit the cache never sees.
+	queryRangeMiddleware = append(queryRangeMiddleware, LimitsMiddleware(limits, codec))
 	if cfg.MaxRetries > 0 {
-		queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware("retry"), NewRetryMiddleware(log, cfg.MaxRetries))
+		queryRangeMiddleware = append(queryRangeMiddleware, InstrumentMiddleware(RetryMiddlewareName), NewRetryMiddleware(log, cfg.MaxRetries))
 	}
 
 	return frontend.Tripperware(func(next http.RoundTripper) http.RoundTripper {
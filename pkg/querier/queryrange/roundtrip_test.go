@@ -0,0 +1,481 @@
+package queryrange
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/weaveworks/common/user"
+)
+
+// fakeRequest is a minimal Request used to drive NewTripperware in tests
+// without depending on the real Prometheus request/response types.
+type fakeRequest struct {
+	start, end, step int64
+	query            string
+}
+
+func (r *fakeRequest) GetStart() int64  { return r.start }
+func (r *fakeRequest) GetEnd() int64    { return r.end }
+func (r *fakeRequest) GetStep() int64   { return r.step }
+func (r *fakeRequest) GetQuery() string { return r.query }
+
+func (r *fakeRequest) WithStartEnd(start, end int64) Request {
+	clone := *r
+	clone.start, clone.end = start, end
+	return &clone
+}
+
+func (r *fakeRequest) WithQuery(query string) Request {
+	clone := *r
+	clone.query = query
+	return &clone
+}
+
+func (r *fakeRequest) Reset()         {}
+func (r *fakeRequest) String() string { return r.query }
+func (r *fakeRequest) ProtoMessage()  {}
+
+type fakeResponse struct{}
+
+func (*fakeResponse) Reset()         {}
+func (*fakeResponse) String() string { return "fakeResponse" }
+func (*fakeResponse) ProtoMessage()  {}
+
+// fakeCodec decodes every incoming http.Request into a copy of template, and
+// stashes the Request that was actually sent downstream (post-middleware) in
+// the outgoing http.Request's context so the test can inspect what each
+// middleware did to it.
+type fakeCodec struct {
+	template *fakeRequest
+}
+
+type sentRequestKey struct{}
+
+func (c fakeCodec) DecodeRequest(context.Context, *http.Request) (Request, error) {
+	clone := *c.template
+	return &clone, nil
+}
+
+func (c fakeCodec) DecodeResponse(context.Context, *http.Response, Request) (Response, error) {
+	return &fakeResponse{}, nil
+}
+
+func (c fakeCodec) EncodeRequest(ctx context.Context, req Request) (*http.Request, error) {
+	httpReq := httptest.NewRequest(http.MethodGet, "http://test/query_range", nil)
+	return httpReq.WithContext(context.WithValue(ctx, sentRequestKey{}, req)), nil
+}
+
+func (c fakeCodec) EncodeResponse(context.Context, Response) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func (c fakeCodec) MergeResponse(...Response) (Response, error) {
+	return &fakeResponse{}, nil
+}
+
+func (c fakeCodec) NewEmptyResponse(Request) (Response, error) {
+	return &fakeResponse{}, nil
+}
+
+type fakeLimits struct {
+	maxQueryParallelism      int
+	querySplitDuration       time.Duration
+	querySplitDurationRecent time.Duration
+	maxQueryLookback         time.Duration
+}
+
+func (l fakeLimits) MaxQueryParallelism(string) int                { return l.maxQueryParallelism }
+func (l fakeLimits) QuerySplitDuration(string) time.Duration       { return l.querySplitDuration }
+func (l fakeLimits) QuerySplitDurationRecent(string) time.Duration { return l.querySplitDurationRecent }
+func (l fakeLimits) MaxQueryLookback(string) time.Duration         { return l.maxQueryLookback }
+
+// recordingRoundTripper stands in for the downstream (e.g. ingester/querier)
+// transport, recording the Request each middleware chain ultimately forwards.
+// Split-out sub-requests are dispatched concurrently (see doRequests), so
+// RoundTrip must be safe for concurrent use, and callers must not assume sent
+// is in chronological order.
+type recordingRoundTripper struct {
+	failFirst int           // number of calls to fail before succeeding, for retry cases
+	delay     time.Duration // artificial latency, to widen the window for concurrency assertions
+
+	mu             sync.Mutex
+	calls          int
+	sent           []Request
+	concurrent     int
+	peakConcurrent int
+}
+
+func (r *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.calls++
+	fail := r.calls <= r.failFirst
+	r.sent = append(r.sent, req.Context().Value(sentRequestKey{}).(Request))
+	r.concurrent++
+	if r.concurrent > r.peakConcurrent {
+		r.peakConcurrent = r.concurrent
+	}
+	r.mu.Unlock()
+
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+	}
+
+	r.mu.Lock()
+	r.concurrent--
+	r.mu.Unlock()
+
+	if fail {
+		return nil, errors.New("synthetic downstream failure")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+// earliestSent returns the recorded request with the smallest Start, i.e. the
+// first chunk in chronological order.
+func earliestSent(reqs []Request) Request {
+	earliest := reqs[0]
+	for _, r := range reqs[1:] {
+		if r.GetStart() < earliest.GetStart() {
+			earliest = r
+		}
+	}
+	return earliest
+}
+
+// runTripperware builds the middleware chain for cfg and fires a single
+// query_range request described by req through it, on behalf of a fixed
+// tenant, and reports whether NewTripperware produced a cache.Cache.
+func runTripperware(t *testing.T, cfg Config, limits Limits, req *fakeRequest, rt *recordingRoundTripper) bool {
+	t.Helper()
+	tripperware, c, err := NewTripperware(cfg, log.NewNopLogger(), limits, fakeCodec{template: req}, nil)
+	if err != nil {
+		t.Fatalf("NewTripperware() error = %v", err)
+	}
+	httpReq := httptest.NewRequest(http.MethodGet, "/api/v1/query_range", nil)
+	httpReq = httpReq.WithContext(user.InjectOrgID(httpReq.Context(), "test"))
+	_, _ = tripperware(rt).RoundTrip(httpReq)
+	return c != nil
+}
+
+// configFieldCase documents, for a single queryrange.Config field, how
+// setting it away from its zero value is expected to change the behavior of
+// the middleware chain NewTripperware builds.
+type configFieldCase struct {
+	mutate func(cfg *Config)
+	assert func(t *testing.T, cfg Config)
+}
+
+func TestNewTripperware_MiddlewareChain(t *testing.T) {
+	weekRange := &fakeRequest{start: 0, end: int64(3 * day / time.Millisecond), step: int64(time.Minute / time.Millisecond), query: "up"}
+
+	cases := map[string]configFieldCase{
+		"AlignQueriesWithStep": {
+			mutate: func(cfg *Config) { cfg.AlignQueriesWithStep = true },
+			assert: func(t *testing.T, cfg Config) {
+				unaligned := &fakeRequest{start: 1, end: 100001, step: 10000, query: "up"}
+
+				off := &recordingRoundTripper{}
+				runTripperware(t, Config{}, fakeLimits{}, unaligned, off)
+				on := &recordingRoundTripper{}
+				runTripperware(t, cfg, fakeLimits{}, unaligned, on)
+
+				if len(off.sent) != 1 || len(on.sent) != 1 {
+					t.Fatalf("expected exactly one downstream call in each case, got off=%d on=%d", len(off.sent), len(on.sent))
+				}
+				if off.sent[0].GetStart() == on.sent[0].GetStart() && off.sent[0].GetEnd() == on.sent[0].GetEnd() {
+					t.Errorf("AlignQueriesWithStep had no observable effect on the forwarded request bounds")
+				}
+			},
+		},
+		"SplitQueriesByInterval": {
+			mutate: func(cfg *Config) { cfg.SplitQueriesByInterval = day },
+			assert: func(t *testing.T, cfg Config) {
+				off := &recordingRoundTripper{}
+				runTripperware(t, Config{}, fakeLimits{}, weekRange, off)
+				on := &recordingRoundTripper{}
+				runTripperware(t, cfg, fakeLimits{}, weekRange, on)
+
+				if len(off.sent) != 1 {
+					t.Errorf("with SplitQueriesByInterval unset, expected 1 downstream call, got %d", len(off.sent))
+				}
+				if len(on.sent) <= 1 {
+					t.Errorf("with SplitQueriesByInterval set, expected more than 1 downstream call, got %d", len(on.sent))
+				}
+			},
+		},
+		"SplitQueriesByIntervalRecent": {
+			mutate: func(cfg *Config) {
+				cfg.QueryIngestersWithin = 6 * time.Hour
+				cfg.SplitQueriesByIntervalRecent = time.Hour
+			},
+			assert: func(t *testing.T, cfg Config) {
+				now := time.Now().UnixNano() / int64(time.Millisecond)
+				req := &fakeRequest{start: now - int64(48*time.Hour/time.Millisecond), end: now, step: int64(time.Minute / time.Millisecond), query: "up"}
+
+				off := &recordingRoundTripper{}
+				runTripperware(t, Config{QueryIngestersWithin: cfg.QueryIngestersWithin}, fakeLimits{}, req, off)
+				on := &recordingRoundTripper{}
+				runTripperware(t, cfg, fakeLimits{}, req, on)
+
+				if len(on.sent) <= len(off.sent) {
+					t.Errorf("SplitQueriesByIntervalRecent had no observable effect: off=%d on=%d downstream calls", len(off.sent), len(on.sent))
+				}
+			},
+		},
+		"QueryIngestersWithin": {
+			// QueryIngestersWithin only has an observable effect once a recent
+			// split interval is also configured; exercised together with
+			// SplitQueriesByIntervalRecent above.
+			mutate: func(cfg *Config) {
+				cfg.QueryIngestersWithin = 6 * time.Hour
+				cfg.SplitQueriesByIntervalRecent = time.Hour
+			},
+			assert: func(t *testing.T, cfg Config) {
+				now := time.Now().UnixNano() / int64(time.Millisecond)
+				req := &fakeRequest{start: now - int64(48*time.Hour/time.Millisecond), end: now, step: int64(time.Minute / time.Millisecond), query: "up"}
+
+				off := &recordingRoundTripper{}
+				runTripperware(t, Config{SplitQueriesByIntervalRecent: cfg.SplitQueriesByIntervalRecent}, fakeLimits{}, req, off)
+				on := &recordingRoundTripper{}
+				runTripperware(t, cfg, fakeLimits{}, req, on)
+
+				if len(on.sent) <= len(off.sent) {
+					t.Errorf("QueryIngestersWithin had no observable effect: off=%d on=%d downstream calls", len(off.sent), len(on.sent))
+				}
+			},
+		},
+		"SplitQueriesAlignment": {
+			mutate: func(cfg *Config) {
+				cfg.SplitQueriesByInterval = 7 * day
+				cfg.SplitQueriesAlignment = CalendarWeek
+			},
+			assert: func(t *testing.T, cfg Config) {
+				// The Unix epoch (1970-01-01) is a Thursday, so Duration
+				// alignment with a 7-day interval snaps to Thursday
+				// boundaries, while CalendarWeek snaps to Monday: the first
+				// chunk's end timestamp must differ between the two modes.
+				req := &fakeRequest{start: 0, end: int64(3 * 7 * day / time.Millisecond), step: int64(time.Minute / time.Millisecond), query: "up"}
+
+				duration := &recordingRoundTripper{}
+				runTripperware(t, Config{SplitQueriesByInterval: 7 * day}, fakeLimits{}, req, duration)
+				calendar := &recordingRoundTripper{}
+				runTripperware(t, cfg, fakeLimits{}, req, calendar)
+
+				if len(duration.sent) == 0 || len(calendar.sent) == 0 {
+					t.Fatalf("expected at least one downstream call in each case")
+				}
+				if earliestSent(duration.sent).GetEnd() == earliestSent(calendar.sent).GetEnd() {
+					t.Errorf("SplitQueriesAlignment had no observable effect on the first chunk's boundary")
+				}
+			},
+		},
+		"SplitQueriesByDay": {
+			mutate: func(cfg *Config) { cfg.SplitQueriesByDay = true },
+			assert: func(t *testing.T, cfg Config) {
+				off := &recordingRoundTripper{}
+				runTripperware(t, Config{}, fakeLimits{}, weekRange, off)
+				on := &recordingRoundTripper{}
+				runTripperware(t, cfg, fakeLimits{}, weekRange, on)
+
+				if len(on.sent) <= len(off.sent) {
+					t.Errorf("SplitQueriesByDay had no observable effect: off=%d on=%d downstream calls", len(off.sent), len(on.sent))
+				}
+			},
+		},
+		"CacheResults": {
+			mutate: func(cfg *Config) { cfg.CacheResults = true },
+			assert: func(t *testing.T, cfg Config) {
+				if gotCache := runTripperware(t, Config{}, fakeLimits{}, weekRange, &recordingRoundTripper{}); gotCache {
+					t.Errorf("expected no cache.Cache when CacheResults is unset")
+				}
+				if gotCache := runTripperware(t, cfg, fakeLimits{}, weekRange, &recordingRoundTripper{}); !gotCache {
+					t.Errorf("expected a cache.Cache when CacheResults is set")
+				}
+			},
+		},
+		"MaxRetries": {
+			mutate: func(cfg *Config) { cfg.MaxRetries = 3 },
+			assert: func(t *testing.T, cfg Config) {
+				off := &recordingRoundTripper{failFirst: 10}
+				runTripperware(t, Config{MaxRetries: 0}, fakeLimits{}, weekRange, off)
+				on := &recordingRoundTripper{failFirst: 10}
+				runTripperware(t, cfg, fakeLimits{}, weekRange, on)
+
+				if off.calls != 1 {
+					t.Errorf("with MaxRetries = 0, expected exactly 1 downstream call, got %d", off.calls)
+				}
+				if on.calls <= off.calls {
+					t.Errorf("MaxRetries had no observable effect: off=%d on=%d downstream calls", off.calls, on.calls)
+				}
+			},
+		},
+	}
+
+	assertAllConfigFieldsCovered(t, cases)
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := Config{}
+			tc.mutate(&cfg)
+			tc.assert(t, cfg)
+		})
+	}
+}
+
+// assertAllConfigFieldsCovered fails the test if queryrange.Config gains a
+// field with no corresponding entry in cases, so a new config knob can't
+// silently go un-plumbed into the middleware chain.
+func assertAllConfigFieldsCovered(t *testing.T, cases map[string]configFieldCase) {
+	t.Helper()
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			// Embedded sub-configs (e.g. ResultsCacheConfig) are gated by
+			// their own bool field and don't need a case of their own.
+			continue
+		}
+		if _, ok := cases[field.Name]; !ok {
+			t.Errorf("queryrange.Config field %q has no case in TestNewTripperware_MiddlewareChain; add one", field.Name)
+		}
+	}
+}
+
+func TestAlignToGridAtOrAfter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		ts, start, step, want int64
+	}{
+		"already on grid":     {ts: 20, start: 0, step: 10, want: 20},
+		"between grid points": {ts: 21, start: 0, step: 10, want: 30},
+		"before start":        {ts: -5, start: 0, step: 10, want: 0},
+		"zero step, no grid":  {ts: 21, start: 0, step: 0, want: 21},
+		"offset start":        {ts: 23, start: 3, step: 10, want: 23},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := alignToGridAtOrAfter(tc.ts, tc.start, tc.step); got != tc.want {
+				t.Errorf("alignToGridAtOrAfter(%d, %d, %d) = %d, want %d", tc.ts, tc.start, tc.step, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestSplitByIntervalMiddleware_RecentPortionOnGrid guards against the
+// recent portion of a dual-interval split starting at the raw
+// End-QueryIngestersWithin boundary: that timestamp isn't necessarily on the
+// original request's Start/Step grid, which would leave a gap or an
+// overlapping, double-counted sample at the seam between the historical and
+// recent sub-queries.
+func TestSplitByIntervalMiddleware_RecentPortionOnGrid(t *testing.T) {
+	step := int64(time.Minute / time.Millisecond)
+	req := &fakeRequest{start: 0, end: int64(3*time.Hour/time.Millisecond) + 17, step: step, query: "up"}
+
+	rt := &recordingRoundTripper{}
+	runTripperware(t, Config{
+		SplitQueriesByInterval:       time.Hour,
+		SplitQueriesByIntervalRecent: 20 * time.Minute,
+		QueryIngestersWithin:         90*time.Minute + 13*time.Millisecond, // deliberately off the step grid
+	}, fakeLimits{}, req, rt)
+
+	if len(rt.sent) < 2 {
+		t.Fatalf("expected at least 2 downstream calls, got %d", len(rt.sent))
+	}
+
+	byStart := make(map[int64]Request, len(rt.sent))
+	for _, sent := range rt.sent {
+		byStart[sent.GetStart()] = sent
+	}
+	if len(byStart) != len(rt.sent) {
+		t.Errorf("two sub-queries shared the same Start: historical and recent portions overlapped at the seam")
+	}
+	for _, sent := range rt.sent {
+		if (sent.GetStart()-req.GetStart())%step != 0 {
+			t.Errorf("sub-query Start %d is not aligned to the request's Start/Step grid", sent.GetStart())
+		}
+	}
+}
+
+// TestNewTripperware_LimitsShortCircuitsBeforeSplit guards against a query
+// entirely outside max_query_lookback being fanned out into every split
+// sub-query before each is individually short-circuited: LimitsMiddleware
+// must reject the whole range up front, so split never runs at all.
+func TestNewTripperware_LimitsShortCircuitsBeforeSplit(t *testing.T) {
+	nowMillis := time.Now().UnixNano() / int64(time.Millisecond)
+	req := &fakeRequest{
+		start: nowMillis - int64(48*time.Hour/time.Millisecond),
+		end:   nowMillis - int64(47*time.Hour/time.Millisecond),
+		step:  int64(time.Minute / time.Millisecond),
+		query: "up",
+	}
+
+	rt := &recordingRoundTripper{}
+	runTripperware(t, Config{SplitQueriesByInterval: 10 * time.Minute}, fakeLimits{maxQueryLookback: time.Hour}, req, rt)
+
+	if len(rt.sent) != 0 {
+		t.Errorf("expected the whole-range lookback short-circuit to pre-empt split entirely, got %d downstream calls", len(rt.sent))
+	}
+}
+
+// TestSplitByIntervalMiddleware_BoundaryNearStartNotDropped guards against a
+// zero-width historical portion silently losing the sample at Start: when
+// end-QueryIngestersWithin lands within one step of Start, recentStart rounds
+// up to Start+Step, leaving the historical portion as the single point
+// [Start,Start].
+func TestSplitByIntervalMiddleware_BoundaryNearStartNotDropped(t *testing.T) {
+	step := int64(time.Minute / time.Millisecond)
+	req := &fakeRequest{start: 0, end: int64(3*time.Hour/time.Millisecond) + 30000, step: step, query: "up"}
+
+	rt := &recordingRoundTripper{}
+	runTripperware(t, Config{
+		SplitQueriesByInterval:       time.Hour,
+		SplitQueriesByIntervalRecent: 20 * time.Minute,
+		QueryIngestersWithin:         3 * time.Hour,
+	}, fakeLimits{}, req, rt)
+
+	for _, sent := range rt.sent {
+		if sent.GetStart() == req.GetStart() {
+			return
+		}
+	}
+	t.Errorf("no sub-query covers the request's Start %d: the boundary sample was dropped", req.GetStart())
+}
+
+// TestDoRequests_MaxQueryParallelism guards the concurrency cap: Limits
+// advertises MaxQueryParallelism as the bound on split sub-queries in
+// flight at once, so doRequests must enforce it rather than firing every
+// sub-query at once.
+func TestDoRequests_MaxQueryParallelism(t *testing.T) {
+	const maxParallelism = 2
+	reqs := make([]Request, 10)
+	for i := range reqs {
+		reqs[i] = &fakeRequest{start: int64(i), end: int64(i) + 1, query: "up"}
+	}
+
+	rt := &recordingRoundTripper{delay: 10 * time.Millisecond}
+	next := HandlerFunc(func(ctx context.Context, r Request) (Response, error) {
+		httpReq, err := (fakeCodec{}).EncodeRequest(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := rt.RoundTrip(httpReq); err != nil {
+			return nil, err
+		}
+		return &fakeResponse{}, nil
+	})
+
+	if _, err := doRequests(context.Background(), next, reqs, maxParallelism); err != nil {
+		t.Fatalf("doRequests() error = %v", err)
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.peakConcurrent > maxParallelism {
+		t.Errorf("peak concurrent downstream calls = %d, want <= %d", rt.peakConcurrent, maxParallelism)
+	}
+}
@@ -0,0 +1,264 @@
+package queryrange
+
+import (
+	"context"
+	"time"
+
+	"github.com/weaveworks/common/user"
+	"golang.org/x/sync/errgroup"
+)
+
+// SplitByIntervalMiddleware creates a new Middleware that splits requests by a given interval.
+//
+// The portion of the request range within queryIngestersWithin of the
+// request's End is split at recentInterval instead of interval, since that
+// portion is served by ingesters and benefits from smaller, more parallel
+// sub-queries. A zero queryIngestersWithin or recentInterval disables this
+// distinction and the whole range is split at interval. alignment only
+// affects the boundaries of the historical (non-recent) portion; the recent
+// portion always splits on fixed-size windows, since it is sized for
+// ingester parallelism rather than calendar-bucketed storage.
+func SplitByIntervalMiddleware(interval, recentInterval, queryIngestersWithin time.Duration, alignment SplitQueriesAlignment, limits Limits, merger Merger) Middleware {
+	return MiddlewareFunc(func(next Handler) Handler {
+		return splitByIntervalMiddleware{
+			next:                 next,
+			limits:               limits,
+			merger:               merger,
+			interval:             interval,
+			recentInterval:       recentInterval,
+			queryIngestersWithin: queryIngestersWithin,
+			alignment:            alignment,
+		}
+	})
+}
+
+type splitByIntervalMiddleware struct {
+	next                 Handler
+	limits               Limits
+	merger               Merger
+	interval             time.Duration
+	recentInterval       time.Duration
+	queryIngestersWithin time.Duration
+	alignment            SplitQueriesAlignment
+}
+
+func (s splitByIntervalMiddleware) Do(ctx context.Context, r Request) (Response, error) {
+	interval := s.interval
+	recentInterval := s.recentInterval
+	var maxParallelism int
+	if userID, err := user.ExtractOrgID(ctx); err == nil {
+		if v := s.limits.QuerySplitDuration(userID); v != 0 {
+			interval = v
+		}
+		if v := s.limits.QuerySplitDurationRecent(userID); v != 0 {
+			recentInterval = v
+		}
+		maxParallelism = s.limits.MaxQueryParallelism(userID)
+	}
+
+	if recentInterval == 0 || s.queryIngestersWithin == 0 {
+		return s.doSplit(ctx, r, interval, s.alignment, maxParallelism)
+	}
+
+	boundary := r.GetEnd() - s.queryIngestersWithin.Milliseconds()
+	if boundary <= r.GetStart() {
+		// The whole range is within the ingester lookback window: it's all
+		// recent portion, which always splits on fixed-size windows.
+		return s.doSplit(ctx, r, recentInterval, Duration, maxParallelism)
+	}
+
+	// The recent portion must start on the same Start/Step grid as the
+	// original request, not at the raw boundary: snapping it to boundary
+	// directly would put its samples off-grid relative to the historical
+	// portion, and would double-count the boundary timestamp (the last
+	// point of the historical portion and the first point of the recent
+	// portion would otherwise coincide).
+	recentStart := alignToGridAtOrAfter(boundary, r.GetStart(), r.GetStep())
+	if recentStart >= r.GetEnd() {
+		// Alignment pushed the recent portion past the end of the range.
+		return s.doSplit(ctx, r, interval, s.alignment, maxParallelism)
+	}
+
+	// historicalEnd is always >= Start here (boundary > Start by the guard
+	// above, and alignToGridAtOrAfter never rounds below Start), but it can
+	// land exactly at Start when recentStart rounded up to the next step:
+	// splitQueryByInterval/splitQueryByCalendar both loop on start < end, so
+	// that zero-width [Start,Start] historical portion would silently vanish
+	// instead of contributing its one sample at Start.
+	historicalEnd := recentStart - r.GetStep()
+	var reqs []Request
+	if historicalEnd == r.GetStart() {
+		reqs = append(reqs, r.WithStartEnd(r.GetStart(), r.GetStart()))
+	} else {
+		reqs = splitQueryByIntervalOrWhole(r.WithStartEnd(r.GetStart(), historicalEnd), interval, s.alignment)
+	}
+	reqs = append(reqs, splitQueryByIntervalOrWhole(r.WithStartEnd(recentStart, r.GetEnd()), recentInterval, Duration)...)
+	return s.mergeRequests(ctx, reqs, maxParallelism)
+}
+
+// doSplit splits r at interval under alignment and merges the results.
+// A zero interval under Duration alignment is a no-op.
+func (s splitByIntervalMiddleware) doSplit(ctx context.Context, r Request, interval time.Duration, alignment SplitQueriesAlignment, maxParallelism int) (Response, error) {
+	if interval == 0 && alignment == Duration {
+		return s.next.Do(ctx, r)
+	}
+	return s.mergeRequests(ctx, splitQueryByIntervalOrWhole(r, interval, alignment), maxParallelism)
+}
+
+func (s splitByIntervalMiddleware) mergeRequests(ctx context.Context, reqs []Request, maxParallelism int) (Response, error) {
+	reqResps, err := doRequests(ctx, s.next, reqs, maxParallelism)
+	if err != nil {
+		return nil, err
+	}
+
+	resps := make([]Response, 0, len(reqResps))
+	for _, reqResp := range reqResps {
+		resps = append(resps, reqResp.Response)
+	}
+
+	return s.merger.MergeResponse(resps...)
+}
+
+type requestResponse struct {
+	Request  Request
+	Response Response
+}
+
+// doRequests executes a set of requests in parallel against next, preserving
+// order. Concurrency is capped at maxParallelism (the tenant's
+// Limits.MaxQueryParallelism); a non-positive value means no cap.
+func doRequests(ctx context.Context, next Handler, reqs []Request, maxParallelism int) ([]requestResponse, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	var sem chan struct{}
+	if maxParallelism > 0 {
+		sem = make(chan struct{}, maxParallelism)
+	}
+	resps := make([]requestResponse, len(reqs))
+	for i, req := range reqs {
+		i, req := i, req
+		g.Go(func() error {
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			resp, err := next.Do(ctx, req)
+			if err != nil {
+				return err
+			}
+			resps[i] = requestResponse{Request: req, Response: resp}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return resps, nil
+}
+
+// alignToGridAtOrAfter returns the smallest timestamp on the grid
+// start, start+step, start+2*step, ... that is >= ts. If step is 0 there is
+// no grid to align to and ts is returned unchanged.
+func alignToGridAtOrAfter(ts, start, step int64) int64 {
+	if step == 0 {
+		return ts
+	}
+	if ts <= start {
+		return start
+	}
+	n := (ts - start + step - 1) / step
+	return start + n*step
+}
+
+// splitQueryByIntervalOrWhole splits r according to alignment, falling back
+// to returning r unsplit when alignment is Duration and interval is zero (a
+// zero interval means "don't split this portion").
+func splitQueryByIntervalOrWhole(r Request, interval time.Duration, alignment SplitQueriesAlignment) []Request {
+	switch alignment {
+	case CalendarDay:
+		return splitQueryByCalendar(r, day)
+	case CalendarWeek:
+		return splitQueryByCalendar(r, 7*day)
+	default:
+		if interval == 0 {
+			return []Request{r}
+		}
+		return splitQueryByInterval(r, interval)
+	}
+}
+
+// splitQueryByInterval splits a query into multiple requests, each covering no
+// more than interval of time.
+func splitQueryByInterval(r Request, interval time.Duration) []Request {
+	var reqs []Request
+	for start := r.GetStart(); start < r.GetEnd(); start = nextIntervalBoundary(start, r.GetStep(), interval) + r.GetStep() {
+		end := nextIntervalBoundary(start, r.GetStep(), interval)
+		if end+r.GetStep() >= r.GetEnd() {
+			end = r.GetEnd()
+		}
+		reqs = append(reqs, r.WithStartEnd(start, end))
+	}
+	return reqs
+}
+
+// nextIntervalBoundary returns the last timestamp, aligned with step, within
+// the interval-sized window (aligned to multiples of interval since the Unix
+// epoch) that contains start.
+func nextIntervalBoundary(start, step int64, interval time.Duration) int64 {
+	nextIntervalStart := (start/interval.Milliseconds() + 1) * interval.Milliseconds()
+	if step == 0 {
+		return nextIntervalStart - 1
+	}
+	nextIntervalStart--
+	return nextIntervalStart - (nextIntervalStart-start)%step
+}
+
+// splitQueryByCalendar splits a query at unit-sized (day or week) boundaries
+// aligned to 00:00 UTC, rather than at fixed offsets from the request start.
+// The first and last sub-query may be shorter than unit.
+func splitQueryByCalendar(r Request, unit time.Duration) []Request {
+	var reqs []Request
+	for start := r.GetStart(); start < r.GetEnd(); start = nextCalendarBoundary(start, r.GetStep(), unit) + r.GetStep() {
+		end := nextCalendarBoundary(start, r.GetStep(), unit)
+		if end+r.GetStep() >= r.GetEnd() {
+			end = r.GetEnd()
+		}
+		reqs = append(reqs, r.WithStartEnd(start, end))
+	}
+	return reqs
+}
+
+// nextCalendarBoundary returns the last timestamp, aligned with step, within
+// the calendar unit (day starting at 00:00 UTC, or week starting at Monday
+// 00:00 UTC) that contains start.
+func nextCalendarBoundary(start, step int64, unit time.Duration) int64 {
+	nextUnitStart := millisFromTime(calendarUnitStart(start, unit).Add(unit))
+	if step == 0 {
+		return nextUnitStart - 1
+	}
+	nextUnitStart--
+	return nextUnitStart - (nextUnitStart-start)%step
+}
+
+// calendarUnitStart returns the start (00:00 UTC) of the day or week
+// containing the millisecond timestamp ms. Weeks start on Monday.
+func calendarUnitStart(ms int64, unit time.Duration) time.Time {
+	dayStart := timeFromMillis(ms).Truncate(24 * time.Hour)
+	if unit == 7*day {
+		// time.Weekday: Sunday=0 .. Saturday=6; shift so Monday=0.
+		offset := (int(dayStart.Weekday()) + 6) % 7
+		return dayStart.AddDate(0, 0, -offset)
+	}
+	return dayStart
+}
+
+func timeFromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+func millisFromTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}